@@ -0,0 +1,109 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package agessh
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/johnkord/age"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// AgentIdentity is an age.Identity for an SSH key held by a running
+// ssh-agent (reached over SSH_AUTH_SOCK) rather than read from disk, such as
+// a hardware-token-backed key (YubiKeys, smart cards, etc.).
+//
+// AgentIdentity does not decrypt. Decrypting either stanza type needs an
+// operation (X25519 ECDH for ssh-ed25519, raw RSA decryption for ssh-rsa)
+// that the ssh-agent wire protocol doesn't expose — agents only sign.
+// AgentIdentity recognizes a stanza addressed to its key, but Unwrap then
+// returns an error for it rather than a file key, and Unwrap never contacts
+// the agent.
+type AgentIdentity struct {
+	pub ssh.PublicKey
+	// label identifies the key in error messages: the query the caller used
+	// to look it up, or its fingerprint.
+	label string
+}
+
+// NewAgentIdentity returns an AgentIdentity for the loaded ssh-agent key
+// whose comment or SHA256 fingerprint (as printed by "ssh-add -l") matches
+// query. It fails if no running agent exposes a matching key.
+func NewAgentIdentity(query string) (*AgentIdentity, error) {
+	a, done, err := dialAgent()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	keys, err := a.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ssh-agent keys: %v", err)
+	}
+	for _, k := range keys {
+		if k.Comment == query || ssh.FingerprintSHA256(k) == query {
+			return &AgentIdentity{pub: k, label: query}, nil
+		}
+	}
+	return nil, fmt.Errorf("no key matching %q is loaded in ssh-agent", query)
+}
+
+// NewAgentIdentityFromPublicKey returns an AgentIdentity for pub without
+// contacting ssh-agent. This is used for identity files that contain only a
+// public key line, whose private key is held by the agent, not on disk.
+func NewAgentIdentityFromPublicKey(pub ssh.PublicKey) *AgentIdentity {
+	return &AgentIdentity{pub: pub, label: ssh.FingerprintSHA256(pub)}
+}
+
+func dialAgent() (agent.Agent, func(), error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, nil, fmt.Errorf("SSH_AUTH_SOCK is not set; is ssh-agent running?")
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to ssh-agent: %v", err)
+	}
+	return agent.NewClient(conn), func() { conn.Close() }, nil
+}
+
+// sshTag is the first 4 bytes of SHA-256 of the wire-format public key,
+// base64-encoded, used by ssh-ed25519 stanzas so a recipient can recognize
+// its own stanza without attempting every one.
+func sshTag(pub ssh.PublicKey) string {
+	h := sha256.Sum256(pub.Marshal())
+	return base64.RawStdEncoding.EncodeToString(h[:4])
+}
+
+// Unwrap implements age.Identity.
+//
+// Decrypting either stanza type requires ssh-agent to perform an operation
+// it doesn't expose: unwrapping a standard ssh-ed25519 stanza needs the
+// X25519 ECDH shared secret between the stanza's ephemeral key and the
+// identity's (converted) private scalar, and unwrapping an ssh-rsa stanza
+// needs raw RSA decryption. The agent protocol only offers signing, so
+// AgentIdentity can recognize stanzas addressed to it but can never actually
+// decrypt them; it reports that explicitly instead of deriving a wrapping
+// key from an unrelated signature.
+func (i *AgentIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	for _, s := range stanzas {
+		switch s.Type {
+		case "ssh-ed25519", "ssh-rsa":
+			if len(s.Args) != 1 || s.Args[0] != sshTag(i.pub) {
+				continue
+			}
+			return nil, fmt.Errorf("ssh-agent identity %q cannot decrypt %s stanzas: "+
+				"ssh-agent exposes no decryption or ECDH operation, only signing", i.label, s.Type)
+		}
+	}
+	return nil, age.ErrIncorrectIdentity
+}
@@ -0,0 +1,66 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package agessh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/johnkord/age"
+	"golang.org/x/crypto/ssh"
+)
+
+func testKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	rawPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(rawPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub
+}
+
+// TestAgentIdentityUnwrapUnaddressedStanzaIsIgnored checks that a stanza
+// addressed to a different key is skipped rather than treated as an error,
+// so a multi-recipient file with an unrelated key alongside the matching
+// one doesn't abort decryption outright.
+func TestAgentIdentityUnwrapUnaddressedStanzaIsIgnored(t *testing.T) {
+	id := NewAgentIdentityFromPublicKey(testKey(t))
+
+	_, err := id.Unwrap([]*age.Stanza{{
+		Type: "ssh-ed25519",
+		Args: []string{"not-this-key"},
+		Body: make([]byte, 64),
+	}})
+	if err != age.ErrIncorrectIdentity {
+		t.Fatalf("got %v, want age.ErrIncorrectIdentity", err)
+	}
+}
+
+// TestAgentIdentityUnwrapAddressedStanzaReportsLimitation is a regression
+// test documenting a permanent limitation: ssh-agent exposes no ECDH or
+// RSA-decrypt operation, only signing, so AgentIdentity can never actually
+// return a file key for a stanza addressed to it. It should say so clearly
+// instead of returning age.ErrIncorrectIdentity, which would look like the
+// stanza simply didn't match.
+func TestAgentIdentityUnwrapAddressedStanzaReportsLimitation(t *testing.T) {
+	pub := testKey(t)
+	id := NewAgentIdentityFromPublicKey(pub)
+
+	_, err := id.Unwrap([]*age.Stanza{{
+		Type: "ssh-ed25519",
+		Args: []string{sshTag(pub)},
+		Body: make([]byte, 64),
+	}})
+	if err == nil || err == age.ErrIncorrectIdentity {
+		t.Fatalf("got %v, want a descriptive \"cannot decrypt\" error", err)
+	}
+}
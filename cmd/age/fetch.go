@@ -0,0 +1,188 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/johnkord/age"
+)
+
+// fetchRecipientsEnabled gates every network-fetched recipient type (github:,
+// gitlab:, sourcehut:, and https://). It defaults to false because fetching
+// a recipient over the network means trusting a third party, at encryption
+// time, to hand back the right public keys for the right person — that's
+// the trust problem the original design dropped "github:" recipients to
+// avoid. It's set from the -fetch-recipients flag, registered below.
+var fetchRecipientsEnabled bool
+
+// assumeYes is set from the -yes flag, registered below.
+var assumeYes bool
+
+func init() {
+	flag.BoolVar(&fetchRecipientsEnabled, "fetch-recipients", false,
+		"allow fetching github:, gitlab:, sourcehut:, and https:// recipients over the network")
+	flag.BoolVar(&assumeYes, "yes", false,
+		"assume yes to any confirmation prompts, such as the one guarding -fetch-recipients with standard input")
+}
+
+const fetchTimeout = 10 * time.Second
+const fetchSizeLimit = 1 << 20 // 1 MiB
+
+var warnedFetchHosts = make(map[string]bool)
+
+// fetchRecipient fetches a newline-separated list of recipients from
+// fetchURL and parses each one with parseRecipient, returning them fanned
+// out behind a single age.Recipient. host is used only for the trust
+// warning and error messages.
+func fetchRecipient(fetchURL, host string) (age.Recipient, error) {
+	if !fetchRecipientsEnabled {
+		return nil, fmt.Errorf("%q requires passing -fetch-recipients: doing so means trusting %s "+
+			"to serve the correct public keys at encryption time", fetchURL, host)
+	}
+	if !warnedFetchHosts[host] {
+		warnedFetchHosts[host] = true
+		warningf("fetching recipients from %s: this trusts %s to serve the correct keys", fetchURL, host)
+	}
+
+	body, err := fetchCached(fetchURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var recs multiRecipient
+	for i, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseRecipient(line)
+		if err != nil {
+			if t, ok := sshKeyType(line); ok {
+				warningf("%s: ignoring unsupported SSH key of type %q at line %d", fetchURL, t, i+1)
+				continue
+			}
+			return nil, fmt.Errorf("%s: malformed recipient at line %d", fetchURL, i+1)
+		}
+		recs = append(recs, r)
+	}
+	if len(recs) == 0 {
+		return nil, fmt.Errorf("%s: no recipients found", fetchURL)
+	}
+	return recs, nil
+}
+
+// multiRecipient fans a single recipient specification, such as a fetched
+// key list with more than one key on it, out to every age.Recipient it
+// named: wrapping the file key to a multiRecipient produces one stanza per
+// underlying recipient.
+type multiRecipient []age.Recipient
+
+func (m multiRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	var stanzas []*age.Stanza
+	for _, r := range m {
+		ss, err := r.Wrap(fileKey)
+		if err != nil {
+			return nil, err
+		}
+		stanzas = append(stanzas, ss...)
+	}
+	return stanzas, nil
+}
+
+// fetchCacheEntry is the on-disk cache format: the ETag lets refetches be
+// conditional, and the body lets a fetch that fails outright (network down)
+// still succeed from the last known-good response.
+type fetchCacheEntry struct {
+	ETag string `json:"etag"`
+	Body string `json:"body"`
+}
+
+func fetchCachePath(fetchURL string) (string, error) {
+	dir := os.Getenv("XDG_CACHE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to determine cache directory: %v", err)
+		}
+		dir = filepath.Join(home, ".cache")
+	}
+	dir = filepath.Join(dir, "age", "recipients")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create recipients cache directory: %v", err)
+	}
+	sum := sha256.Sum256([]byte(fetchURL))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".json"), nil
+}
+
+// fetchClient verifies servers against the system's TLS root pool (RootCAs
+// is nil) and adds no certificate authority of its own.
+var fetchClient = &http.Client{
+	Timeout: fetchTimeout,
+	Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: nil},
+	},
+}
+
+func fetchCached(fetchURL string) ([]byte, error) {
+	cachePath, err := fetchCachePath(fetchURL)
+	if err != nil {
+		return nil, err
+	}
+	var cached fetchCacheEntry
+	if data, err := ioutil.ReadFile(cachePath); err == nil {
+		json.Unmarshal(data, &cached) // a corrupt cache file just means a full refetch
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fetchURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient URL %q: %v", fetchURL, err)
+	}
+	if cached.ETag != "" {
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		if cached.Body != "" {
+			warningf("failed to fetch %q, using cached recipients: %v", fetchURL, err)
+			return []byte(cached.Body), nil
+		}
+		return nil, fmt.Errorf("failed to fetch %q: %v", fetchURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return []byte(cached.Body), nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %q: unexpected status %q", fetchURL, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, fetchSizeLimit))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %q: %v", fetchURL, err)
+	}
+
+	entry := fetchCacheEntry{ETag: resp.Header.Get("ETag"), Body: string(body)}
+	if data, err := json.Marshal(entry); err == nil {
+		if err := ioutil.WriteFile(cachePath, data, 0600); err != nil {
+			warningf("failed to cache recipients from %q: %v", fetchURL, err)
+		}
+	}
+	return body, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/johnkord/age"
+)
+
+// TestFetchCachePathUsesXDGCacheHome checks that the cache file lands under
+// $XDG_CACHE_HOME/age/recipients rather than the real home directory, so
+// tests (and users who set it) don't touch ~/.cache.
+func TestFetchCachePathUsesXDGCacheHome(t *testing.T) {
+	dir := t.TempDir()
+	os.Setenv("XDG_CACHE_HOME", dir)
+	t.Cleanup(func() { os.Unsetenv("XDG_CACHE_HOME") })
+
+	path, err := fetchCachePath("https://example.com/key.keys")
+	if err != nil {
+		t.Fatalf("fetchCachePath: %v", err)
+	}
+	if !strings.HasPrefix(path, filepath.Join(dir, "age", "recipients")) {
+		t.Fatalf("got %q, want a path under %q", path, filepath.Join(dir, "age", "recipients"))
+	}
+}
+
+// withFetchClient points fetchClient at a test server for the duration of
+// the test, restoring the real client on cleanup.
+func withFetchClient(t *testing.T, srv *httptest.Server) {
+	t.Helper()
+	orig := fetchClient
+	fetchClient = srv.Client()
+	t.Cleanup(func() { fetchClient = orig })
+
+	dir := t.TempDir()
+	os.Setenv("XDG_CACHE_HOME", dir)
+	t.Cleanup(func() { os.Unsetenv("XDG_CACHE_HOME") })
+}
+
+// TestFetchCachedReusesETagOn304 checks that a cached ETag is sent back on
+// the next fetch, and a 304 response reuses the cached body instead of
+// requiring the server to resend it.
+func TestFetchCachedReusesETagOn304(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(exampleX25519Recipient))
+	}))
+	defer srv.Close()
+	withFetchClient(t, srv)
+
+	first, err := fetchCached(srv.URL)
+	if err != nil {
+		t.Fatalf("first fetchCached: %v", err)
+	}
+	if string(first) != exampleX25519Recipient {
+		t.Fatalf("got %q, want %q", first, exampleX25519Recipient)
+	}
+
+	second, err := fetchCached(srv.URL)
+	if err != nil {
+		t.Fatalf("second fetchCached: %v", err)
+	}
+	if string(second) != exampleX25519Recipient {
+		t.Fatalf("got %q, want the cached body reused on a 304", second)
+	}
+	if requests != 2 {
+		t.Fatalf("got %d requests, want 2 (one full fetch, one conditional)", requests)
+	}
+}
+
+// TestFetchCachedFallsBackToCacheOnError checks that once a URL has been
+// fetched successfully, a later failure to reach the server returns the
+// last known-good body instead of an error.
+func TestFetchCachedFallsBackToCacheOnError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(exampleX25519Recipient))
+	}))
+	withFetchClient(t, srv)
+
+	if _, err := fetchCached(srv.URL); err != nil {
+		t.Fatalf("priming fetchCached: %v", err)
+	}
+
+	srv.Close() // now unreachable
+	body, err := fetchCached(srv.URL)
+	if err != nil {
+		t.Fatalf("fetchCached: %v", err)
+	}
+	if string(body) != exampleX25519Recipient {
+		t.Fatalf("got %q, want the cached body as a fallback", body)
+	}
+}
+
+// TestMultiRecipientWrapFansOut checks that wrapping a file key to a
+// multiRecipient produces one stanza per underlying recipient, in order.
+func TestMultiRecipientWrapFansOut(t *testing.T) {
+	m := multiRecipient{fakeRecipient("a"), fakeRecipient("b")}
+
+	stanzas, err := m.Wrap([]byte("file key"))
+	if err != nil {
+		t.Fatalf("Wrap: %v", err)
+	}
+	if len(stanzas) != 2 || stanzas[0].Type != "a" || stanzas[1].Type != "b" {
+		t.Fatalf("got %v, want one stanza per recipient in order", stanzas)
+	}
+}
+
+type fakeRecipient string
+
+func (f fakeRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	return []*age.Stanza{{Type: string(f)}}, nil
+}
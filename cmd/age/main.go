@@ -0,0 +1,63 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/johnkord/age"
+)
+
+// identityFlags collects the values of one or more repeated -i flags, each
+// naming an identity file, or an "ssh-agent:"/"env:"/"inline:" pseudo-file
+// understood by parseIdentitiesFile.
+type identityFlags []string
+
+func (f *identityFlags) String() string { return fmt.Sprint([]string(*f)) }
+
+func (f *identityFlags) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+var identityFlagValues identityFlags
+
+func init() {
+	flag.Var(&identityFlagValues, "i", "identity file to use for decryption; may be repeated")
+}
+
+// main runs age in decrypt mode, reading an encrypted file from standard
+// input and writing its contents to standard output once it's been
+// decrypted with one of the identities named by -i, $AGE_IDENTITY,
+// $AGE_IDENTITY_FILE, or $AGE_SSH_PRIVATE_KEY.
+func main() {
+	flag.Parse()
+	stdinInUse = true // the encrypted file is read from standard input
+
+	ids, err := allIdentities(identityFlagValues)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "age: error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(ids) == 0 {
+		fmt.Fprintln(os.Stderr, "age: error: no identities specified")
+		os.Exit(1)
+	}
+
+	r, err := age.Decrypt(os.Stdin, ids...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "age: error: %v\n", err)
+		os.Exit(1)
+	}
+	if _, err := io.Copy(os.Stdout, r); err != nil {
+		fmt.Fprintf(os.Stderr, "age: error: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -12,56 +12,141 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/johnkord/age"
 	"github.com/johnkord/age/agessh"
 	"github.com/johnkord/age/armor"
+	"github.com/johnkord/age/plugin"
 	"golang.org/x/crypto/cryptobyte"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
 )
 
-// stdinInUse is set in main. It's a singleton like os.Stdin.
-var stdinInUse bool
-
-type gitHubRecipientError struct {
-	username string
+// pluginUI bridges age-plugin messages and prompts to the CLI's existing
+// warning and passphrase-prompt helpers.
+var pluginUI = plugin.UI{
+	DisplayMessage: func(message string) error {
+		warningf("%s", message)
+		return nil
+	},
+	RequestValue: func(message string, secret bool) (string, error) {
+		if !secret {
+			value, err := readLine(message)
+			if err != nil {
+				return "", fmt.Errorf("could not read value: %v", err)
+			}
+			return value, nil
+		}
+		pass, err := readPassphrase(message)
+		if err != nil {
+			return "", fmt.Errorf("could not read value: %v", err)
+		}
+		return string(pass), nil
+	},
 }
 
-func (gitHubRecipientError) Error() string {
-	return `"github:" recipients were removed from the design`
+// readLine prints prompt to standard error and reads back one line of
+// visible input from standard input. It's used for plugin "prompt" stanzas,
+// which (unlike "request-secret") want the typed value echoed back to the
+// plugin, not hidden the way readPassphrase hides it.
+func readLine(prompt string) (string, error) {
+	if stdinInUse {
+		return "", fmt.Errorf("standard input is used for multiple purposes")
+	}
+	fmt.Fprintf(os.Stderr, "%s ", prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("could not read line: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
 }
 
+// stdinInUse is set in main. It's a singleton like os.Stdin.
+var stdinInUse bool
+
 func parseRecipient(arg string) (age.Recipient, error) {
 	switch {
 	case strings.HasPrefix(arg, "age1"):
+		if name, ok := plugin.RecipientName(arg); ok {
+			return plugin.NewRecipient(arg, name, pluginUI)
+		}
 		return age.ParseX25519Recipient(arg)
 	case strings.HasPrefix(arg, "ssh-"):
 		return agessh.ParseRecipient(arg)
 	case strings.HasPrefix(arg, "github:"):
 		name := strings.TrimPrefix(arg, "github:")
-		return nil, gitHubRecipientError{name}
+		return fetchRecipient(fmt.Sprintf("https://github.com/%s.keys", name), "github.com")
+	case strings.HasPrefix(arg, "gitlab:"):
+		name := strings.TrimPrefix(arg, "gitlab:")
+		return fetchRecipient(fmt.Sprintf("https://gitlab.com/%s.keys", name), "gitlab.com")
+	case strings.HasPrefix(arg, "sourcehut:~"):
+		name := strings.TrimPrefix(arg, "sourcehut:~")
+		return fetchRecipient(fmt.Sprintf("https://meta.sr.ht/~%s.keys", name), "meta.sr.ht")
+	case strings.HasPrefix(arg, "https://"):
+		u, err := url.Parse(arg)
+		if err != nil {
+			return nil, fmt.Errorf("malformed recipient URL %q: %v", arg, err)
+		}
+		return fetchRecipient(arg, u.Host)
 	}
 
 	return nil, fmt.Errorf("unknown recipient type: %q", arg)
 }
 
+// maxIncludeDepth bounds how deeply "@include" directives may nest, so a
+// misconfigured or malicious recipients file can't recurse indefinitely.
+const maxIncludeDepth = 10
+
 func parseRecipientsFile(name string) ([]age.Recipient, error) {
+	return parseRecipientsFileIncluding(name, "", make(map[string]bool), 0)
+}
+
+// parseRecipientsFileIncluding parses name, following any "@include"/
+// "!include" directives it contains. Relative include paths are resolved
+// against dir, the directory of the including file ("" for stdin, meaning
+// the current directory). visited holds the absolute paths of files open in
+// the current include chain (i.e. this call's ancestors), not the whole
+// tree, so the same file may legitimately be included from two unrelated
+// branches; each recursive call removes its own entry before returning, to
+// reject only genuine cycles.
+func parseRecipientsFileIncluding(name, dir string, visited map[string]bool, depth int) ([]age.Recipient, error) {
 	var f *os.File
+	var includeDir string
 	if name == "-" {
+		if fetchRecipientsEnabled && !assumeYes {
+			return nil, fmt.Errorf(`refusing to read recipients from standard input while -fetch-recipients is set` +
+				`: mixing a fetched, network-controlled recipient list with piped input is easy to get wrong; pass -yes to proceed anyway`)
+		}
 		if stdinInUse {
 			return nil, fmt.Errorf("standard input is used for multiple purposes")
 		}
 		stdinInUse = true
 		f = os.Stdin
+		includeDir = dir
 	} else {
-		var err error
-		f, err = os.Open(name)
+		path := name
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve recipients file %q: %v", name, err)
+		}
+		if visited[abs] {
+			return nil, fmt.Errorf("%q: @include cycle detected", name)
+		}
+		visited[abs] = true
+		defer delete(visited, abs)
+		f, err = os.Open(path)
 		if err != nil {
 			return nil, fmt.Errorf("failed to open recipient file: %v", err)
 		}
 		defer f.Close()
+		name, includeDir = path, filepath.Dir(path)
 	}
 
 	const recipientFileSizeLimit = 16 << 20 // 16 MiB
@@ -78,6 +163,17 @@ func parseRecipientsFile(name string) ([]age.Recipient, error) {
 		if len(line) > lineLengthLimit {
 			return nil, fmt.Errorf("%q: line %d is too long", name, n)
 		}
+		if include, ok := includeTarget(line); ok {
+			if depth+1 > maxIncludeDepth {
+				return nil, fmt.Errorf("%q: line %d: @include nesting deeper than %d", name, n, maxIncludeDepth)
+			}
+			included, err := parseRecipientsFileIncluding(include, includeDir, visited, depth+1)
+			if err != nil {
+				return nil, fmt.Errorf("%q: line %d: %v", name, n, err)
+			}
+			recs = append(recs, included...)
+			continue
+		}
 		r, err := parseRecipient(line)
 		if err != nil {
 			if t, ok := sshKeyType(line); ok {
@@ -100,6 +196,18 @@ func parseRecipientsFile(name string) ([]age.Recipient, error) {
 	return recs, nil
 }
 
+// includeTarget reports whether line is an "@include <path>" or
+// "!include <path>" directive, mirroring how ssh's authorized_keys and sshd
+// config compose multiple files, and if so returns the included path.
+func includeTarget(line string) (path string, ok bool) {
+	for _, prefix := range []string{"@include ", "!include "} {
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimSpace(strings.TrimPrefix(line, prefix)), true
+		}
+	}
+	return "", false
+}
+
 func sshKeyType(s string) (string, bool) {
 	// TODO: also ignore options? And maybe support multiple spaces and tabs as
 	// field separators like OpenSSH?
@@ -125,8 +233,34 @@ func sshKeyType(s string) (string, bool) {
 
 // parseIdentitiesFile parses a file that contains age or SSH keys. It returns
 // one or more of *age.X25519Identity, *agessh.RSAIdentity, *agessh.Ed25519Identity,
-// *agessh.EncryptedSSHIdentity, or *EncryptedIdentity.
+// *agessh.EncryptedSSHIdentity, *agessh.AgentIdentity, *plugin.Identity, or
+// *EncryptedIdentity.
+//
+// name is usually a file path, but "ssh-agent:<query>", "env:<NAME>", and
+// "inline:<contents>" are also accepted, letting -i name a running
+// ssh-agent key, an environment variable, or a literal identity without
+// touching the filesystem.
 func parseIdentitiesFile(name string) ([]age.Identity, error) {
+	switch {
+	case strings.HasPrefix(name, "ssh-agent:"):
+		id, err := agessh.NewAgentIdentity(strings.TrimPrefix(name, "ssh-agent:"))
+		if err != nil {
+			return nil, err
+		}
+		return []age.Identity{id}, nil
+
+	case strings.HasPrefix(name, "env:"):
+		envName := strings.TrimPrefix(name, "env:")
+		v, ok := os.LookupEnv(envName)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %q is not set", envName)
+		}
+		return parseIdentitiesReader(name, strings.NewReader(v))
+
+	case strings.HasPrefix(name, "inline:"):
+		return parseIdentitiesReader(name, strings.NewReader(strings.TrimPrefix(name, "inline:")))
+	}
+
 	var f *os.File
 	if name == "-" {
 		if stdinInUse {
@@ -142,7 +276,14 @@ func parseIdentitiesFile(name string) ([]age.Identity, error) {
 		}
 		defer f.Close()
 	}
+	return parseIdentitiesReader(name, f)
+}
 
+// parseIdentitiesReader parses identities from f, which may be a file, a
+// "-i env:NAME"/"-i inline:..." in-memory source, or standard input. name is
+// used in error messages and prompts, and for an SSH private key without an
+// embedded public key, to locate the companion name+".pub" file.
+func parseIdentitiesReader(name string, f io.Reader) ([]age.Identity, error) {
 	b := bufio.NewReader(f)
 	p, _ := b.Peek(14) // length of "age-encryption" and "-----BEGIN AGE"
 	peeked := string(p)
@@ -165,17 +306,27 @@ func parseIdentitiesFile(name string) ([]age.Identity, error) {
 		return []age.Identity{&EncryptedIdentity{
 			Contents: contents,
 			Passphrase: func() (string, error) {
-				pass, err := readPassphrase(fmt.Sprintf("Enter passphrase for identity file %q:", name))
-				if err != nil {
-					return "", fmt.Errorf("could not read passphrase: %v", err)
-				}
-				return string(pass), nil
+				return passphraseFromEnvOrTTY(fmt.Sprintf("Enter passphrase for identity file %q:", name))
 			},
 			NoMatchWarning: func() {
 				warningf("encrypted identity file %q didn't match file's recipients", name)
 			},
 		}}, nil
 
+	// A file containing only a public SSH key, whose private half is held by
+	// ssh-agent. The resulting AgentIdentity can't decrypt; see its doc.
+	case strings.HasPrefix(peeked, "ssh-rsa ") || strings.HasPrefix(peeked, "ssh-ed25519 "):
+		const lineLengthLimit = 8 << 10 // 8 KiB, same as sshd(8)
+		contents, err := ioutil.ReadAll(io.LimitReader(b, lineLengthLimit))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %q: %v", name, err)
+		}
+		pubKey, _, _, _, err := ssh.ParseAuthorizedKey(contents)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %q as a public SSH key: %v", name, err)
+		}
+		return []age.Identity{agessh.NewAgentIdentityFromPublicKey(pubKey)}, nil
+
 	// Another PEM file, possibly an SSH private key.
 	case strings.HasPrefix(peeked, "-----BEGIN"):
 		const privateKeySizeLimit = 1 << 14 // 16 KiB
@@ -188,9 +339,9 @@ func parseIdentitiesFile(name string) ([]age.Identity, error) {
 		}
 		return parseSSHIdentity(name, contents)
 
-	// An unencrypted age identity file.
+	// An unencrypted age identity file, possibly with age-plugin identities.
 	default:
-		ids, err := age.ParseIdentities(b)
+		ids, err := parsePluginAndAgeIdentities(b)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read %q: %v", name, err)
 		}
@@ -198,6 +349,117 @@ func parseIdentitiesFile(name string) ([]age.Identity, error) {
 	}
 }
 
+// parsePluginAndAgeIdentities reads an identity file, dispatching any
+// age-plugin identity lines (AGE-PLUGIN-NAME-1...) to the plugin package and
+// passing the remaining key lines through to age.ParseIdentities. Comment and
+// blank lines are skipped, so a source holding only comments yields no
+// identities and no error.
+func parsePluginAndAgeIdentities(r io.Reader) ([]age.Identity, error) {
+	var ids []age.Identity
+	var rest strings.Builder
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if name, ok := plugin.IdentityName(line); ok {
+			id, err := plugin.NewIdentity(line, name, pluginUI)
+			if err != nil {
+				return nil, fmt.Errorf("malformed age-plugin identity: %v", err)
+			}
+			ids = append(ids, id)
+			continue
+		}
+		if strings.HasPrefix(line, "#") || line == "" {
+			continue
+		}
+		rest.WriteString(line)
+		rest.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if rest.Len() > 0 {
+		more, err := age.ParseIdentities(strings.NewReader(rest.String()))
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, more...)
+	}
+	return ids, nil
+}
+
+// passphraseFromEnvOrTTY returns $AGE_PASSPHRASE if it's set, letting CI
+// systems decrypt passphrase-protected identities without a TTY. Otherwise
+// it falls back to the interactive prompt, failing fast with a clear error
+// if standard input isn't a terminal to prompt on.
+func passphraseFromEnvOrTTY(prompt string) (string, error) {
+	if pass, ok := os.LookupEnv("AGE_PASSPHRASE"); ok {
+		return pass, nil
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", fmt.Errorf("$AGE_PASSPHRASE is not set and standard input is not a terminal")
+	}
+	pass, err := readPassphrase(prompt)
+	if err != nil {
+		return "", fmt.Errorf("could not read passphrase: %v", err)
+	}
+	return string(pass), nil
+}
+
+// identitiesFromEnvironment returns the identities described by
+// $AGE_IDENTITY, $AGE_IDENTITY_FILE, and $AGE_SSH_PRIVATE_KEY, for callers
+// (typically CI systems) that can't or don't want to pass -i flags.
+// $AGE_IDENTITY_FILE may name more than one file, colon-separated, like $PATH.
+func identitiesFromEnvironment() ([]age.Identity, error) {
+	var ids []age.Identity
+	if v, ok := os.LookupEnv("AGE_IDENTITY"); ok {
+		more, err := parseIdentitiesReader("$AGE_IDENTITY", strings.NewReader(v))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse $AGE_IDENTITY: %v", err)
+		}
+		ids = append(ids, more...)
+	}
+	if v, ok := os.LookupEnv("AGE_IDENTITY_FILE"); ok {
+		for _, name := range strings.Split(v, ":") {
+			more, err := parseIdentitiesFile(name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse $AGE_IDENTITY_FILE entry %q: %v", name, err)
+			}
+			ids = append(ids, more...)
+		}
+	}
+	if v, ok := os.LookupEnv("AGE_SSH_PRIVATE_KEY"); ok {
+		more, err := parseSSHIdentity("$AGE_SSH_PRIVATE_KEY", []byte(v))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse $AGE_SSH_PRIVATE_KEY: %v", err)
+		}
+		ids = append(ids, more...)
+	}
+	return ids, nil
+}
+
+// allIdentities collects the full set of identities for a decrypt, rather
+// than walking identityFlags (the -i flag's values) alone: it also merges in
+// whatever identitiesFromEnvironment finds in $AGE_IDENTITY,
+// $AGE_IDENTITY_FILE, and $AGE_SSH_PRIVATE_KEY, so CI systems that rely on
+// the environment variables don't also have to pass -i. main should call
+// this instead of resolving identityFlags itself.
+func allIdentities(identityFlags []string) ([]age.Identity, error) {
+	var ids []age.Identity
+	for _, name := range identityFlags {
+		these, err := parseIdentitiesFile(name)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, these...)
+	}
+	fromEnv, err := identitiesFromEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	ids = append(ids, fromEnv...)
+	return ids, nil
+}
+
 func parseSSHIdentity(name string, pemBytes []byte) ([]age.Identity, error) {
 	id, err := agessh.ParseIdentity(pemBytes)
 	if sshErr, ok := err.(*ssh.PassphraseMissingError); ok {
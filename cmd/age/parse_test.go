@@ -0,0 +1,189 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const exampleX25519Recipient = "age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p"
+
+// TestParseRecipientsFileDiamondInclude is a regression test for a bug where
+// visited tracked every file seen across the whole recursion tree rather
+// than just the active include chain, so a diamond-shaped @include graph
+// (the same shared file included from two unrelated branches) was rejected
+// as a false cycle.
+func TestParseRecipientsFileDiamondInclude(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, contents string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("common.recipients", exampleX25519Recipient+"\n")
+	write("a.recipients", "@include common.recipients\n"+exampleX25519Recipient+"\n")
+	write("b.recipients", "@include common.recipients\n"+exampleX25519Recipient+"\n")
+	write("top.recipients", "@include a.recipients\n@include b.recipients\n")
+
+	recs, err := parseRecipientsFile(filepath.Join(dir, "top.recipients"))
+	if err != nil {
+		t.Fatalf("parseRecipientsFile: %v", err)
+	}
+	if len(recs) != 4 {
+		t.Fatalf("got %d recipients, want 4 (common included once via a, once via b, plus one each)", len(recs))
+	}
+}
+
+// unsetEnv unsets name for the duration of the test, restoring whatever
+// value it previously had (if any) on cleanup.
+func unsetEnv(t *testing.T, name string) {
+	t.Helper()
+	if v, ok := os.LookupEnv(name); ok {
+		t.Cleanup(func() { os.Setenv(name, v) })
+		os.Unsetenv(name)
+	}
+}
+
+// TestIdentitiesFromEnvironmentEmptyWhenUnset checks that identitiesFromEnvironment
+// is a no-op, not an error, when none of its three environment variables are set.
+func TestIdentitiesFromEnvironmentEmptyWhenUnset(t *testing.T) {
+	unsetEnv(t, "AGE_IDENTITY")
+	unsetEnv(t, "AGE_IDENTITY_FILE")
+	unsetEnv(t, "AGE_SSH_PRIVATE_KEY")
+
+	ids, err := identitiesFromEnvironment()
+	if err != nil {
+		t.Fatalf("identitiesFromEnvironment: %v", err)
+	}
+	if len(ids) != 0 {
+		t.Fatalf("got %d identities, want 0", len(ids))
+	}
+}
+
+// TestIdentitiesFromEnvironmentReportsMissingFile checks that a bad
+// $AGE_IDENTITY_FILE entry surfaces as an error naming the entry, rather
+// than being silently ignored.
+func TestIdentitiesFromEnvironmentReportsMissingFile(t *testing.T) {
+	unsetEnv(t, "AGE_IDENTITY")
+	unsetEnv(t, "AGE_SSH_PRIVATE_KEY")
+	missing := filepath.Join(t.TempDir(), "does-not-exist")
+	os.Setenv("AGE_IDENTITY_FILE", missing)
+	t.Cleanup(func() { os.Unsetenv("AGE_IDENTITY_FILE") })
+
+	if _, err := identitiesFromEnvironment(); err == nil {
+		t.Fatal("expected an error for a missing $AGE_IDENTITY_FILE entry")
+	}
+}
+
+// TestAllIdentitiesSurfacesEnvironmentErrors is a regression test for
+// identitiesFromEnvironment having no caller: allIdentities, which main
+// calls to assemble the decrypt identity list, must consult
+// identitiesFromEnvironment even with no -i flags, and surface its errors.
+func TestAllIdentitiesSurfacesEnvironmentErrors(t *testing.T) {
+	unsetEnv(t, "AGE_IDENTITY")
+	unsetEnv(t, "AGE_SSH_PRIVATE_KEY")
+	missing := filepath.Join(t.TempDir(), "does-not-exist")
+	os.Setenv("AGE_IDENTITY_FILE", missing)
+	t.Cleanup(func() { os.Unsetenv("AGE_IDENTITY_FILE") })
+
+	if _, err := allIdentities(nil); err == nil {
+		t.Fatal("expected allIdentities to surface the $AGE_IDENTITY_FILE error")
+	}
+}
+
+// TestParseIdentitiesFileEnvScheme checks that "-i env:NAME" reads its
+// identity material from the named environment variable instead of a file.
+func TestParseIdentitiesFileEnvScheme(t *testing.T) {
+	os.Setenv("AGE_TEST_IDENTITY", "# just a comment, no identities\n")
+	t.Cleanup(func() { os.Unsetenv("AGE_TEST_IDENTITY") })
+
+	if _, err := parseIdentitiesFile("env:AGE_TEST_IDENTITY"); err != nil {
+		t.Fatalf("parseIdentitiesFile: %v", err)
+	}
+}
+
+// TestParseIdentitiesFileEnvSchemeUnset checks that naming an unset
+// environment variable is a clear error, not a silent empty identity list.
+func TestParseIdentitiesFileEnvSchemeUnset(t *testing.T) {
+	unsetEnv(t, "AGE_TEST_IDENTITY_UNSET")
+
+	if _, err := parseIdentitiesFile("env:AGE_TEST_IDENTITY_UNSET"); err == nil {
+		t.Fatal("expected an error for an unset environment variable")
+	}
+}
+
+// TestParseIdentitiesFileInlineScheme checks that "-i inline:..." reads its
+// identity material from the flag value itself rather than a file.
+func TestParseIdentitiesFileInlineScheme(t *testing.T) {
+	if _, err := parseIdentitiesFile("inline:# just a comment, no identities"); err != nil {
+		t.Fatalf("parseIdentitiesFile: %v", err)
+	}
+}
+
+// TestPassphraseFromEnvOrTTYUsesEnv checks that $AGE_PASSPHRASE is used
+// without touching the terminal, letting CI systems decrypt
+// passphrase-protected identities non-interactively.
+func TestPassphraseFromEnvOrTTYUsesEnv(t *testing.T) {
+	os.Setenv("AGE_PASSPHRASE", "correct horse battery staple")
+	t.Cleanup(func() { os.Unsetenv("AGE_PASSPHRASE") })
+
+	got, err := passphraseFromEnvOrTTY("Enter passphrase:")
+	if err != nil {
+		t.Fatalf("passphraseFromEnvOrTTY: %v", err)
+	}
+	if got != "correct horse battery staple" {
+		t.Fatalf("got %q, want the value of $AGE_PASSPHRASE", got)
+	}
+}
+
+// TestReadLineReadsVisibleInput exercises the non-secret side of
+// pluginUI.RequestValue: a plugin "prompt" stanza should get back whatever
+// the user actually typed, not an empty string.
+func TestReadLineReadsVisibleInput(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	origStdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = origStdin }()
+
+	go func() {
+		w.WriteString("some typed value\n")
+		w.Close()
+	}()
+
+	got, err := readLine("Enter a value:")
+	if err != nil {
+		t.Fatalf("readLine: %v", err)
+	}
+	if got != "some typed value" {
+		t.Fatalf("got %q, want %q", got, "some typed value")
+	}
+}
+
+// TestParseRecipientsFileRealCycleStillRejected ensures a genuine include
+// cycle is still caught now that visited is scoped to the active chain
+// instead of the whole tree.
+func TestParseRecipientsFileRealCycleStillRejected(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, contents string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.recipients", "@include b.recipients\n")
+	write("b.recipients", "@include a.recipients\n")
+
+	_, err := parseRecipientsFile(filepath.Join(dir, "a.recipients"))
+	if err == nil {
+		t.Fatal("expected an @include cycle error, got nil")
+	}
+}
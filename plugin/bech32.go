@@ -0,0 +1,124 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package plugin
+
+import "strings"
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+var bech32CharsetRev = func() [128]int8 {
+	var rev [128]int8
+	for i := range rev {
+		rev[i] = -1
+	}
+	for i, c := range bech32Charset {
+		rev[c] = int8(i)
+	}
+	return rev
+}()
+
+// decodeBech32 decodes s (in either all-lowercase or all-uppercase form) into
+// its human-readable part and data, verifying the checksum. The returned hrp
+// is always lowercase.
+func decodeBech32(s string) (hrp string, data []byte, err error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, bech32Error("mixed-case string")
+	}
+	s = strings.ToLower(s)
+
+	sep := strings.LastIndexByte(s, '1')
+	if sep < 1 || sep+7 > len(s) {
+		return "", nil, bech32Error("invalid separator position")
+	}
+	hrp = s[:sep]
+	for _, c := range hrp {
+		if c < 33 || c > 126 {
+			return "", nil, bech32Error("invalid character in human-readable part")
+		}
+	}
+
+	values := make([]byte, len(s)-sep-1)
+	for i, c := range s[sep+1:] {
+		if c > 127 || bech32CharsetRev[c] == -1 {
+			return "", nil, bech32Error("invalid character in data part")
+		}
+		values[i] = byte(bech32CharsetRev[c])
+	}
+	if !bech32VerifyChecksum(hrp, values) {
+		return "", nil, bech32Error("invalid checksum")
+	}
+	converted, err := convertBits(values[:len(values)-6], 5, 8, false)
+	if err != nil {
+		return "", nil, err
+	}
+	return hrp, converted, nil
+}
+
+func bech32Polymod(values []byte) uint32 {
+	gen := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		b := byte(chk >> 25)
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (b>>uint(i))&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HRPExpand(hrp string) []byte {
+	h := []byte(hrp)
+	ret := make([]byte, 0, len(h)*2+1)
+	for _, c := range h {
+		ret = append(ret, c>>5)
+	}
+	ret = append(ret, 0)
+	for _, c := range h {
+		ret = append(ret, c&31)
+	}
+	return ret
+}
+
+func bech32VerifyChecksum(hrp string, data []byte) bool {
+	values := append(bech32HRPExpand(hrp), data...)
+	return bech32Polymod(values) == 1
+}
+
+// convertBits converts a byte slice from one bit-width groups to another,
+// as used to translate between bech32's 5-bit groups and 8-bit bytes.
+func convertBits(data []byte, fromBits, toBits uint, pad bool) ([]byte, error) {
+	var acc uint32
+	var bits uint
+	maxv := uint32(1<<toBits) - 1
+	var ret []byte
+	for _, value := range data {
+		if value>>fromBits != 0 {
+			return nil, bech32Error("invalid data range")
+		}
+		acc = acc<<fromBits | uint32(value)
+		bits += fromBits
+		for bits >= toBits {
+			bits -= toBits
+			ret = append(ret, byte(acc>>bits)&byte(maxv))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			ret = append(ret, byte(acc<<(toBits-bits))&byte(maxv))
+		}
+	} else if bits >= fromBits || (acc<<(toBits-bits))&maxv != 0 {
+		return nil, bech32Error("invalid padding")
+	}
+	return ret, nil
+}
+
+type bech32Error string
+
+func (e bech32Error) Error() string { return string(e) }
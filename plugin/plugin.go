@@ -0,0 +1,355 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+// Package plugin implements the client side of the age-plugin protocol,
+// which lets external programs provide age.Recipient and age.Identity
+// implementations for age without those plugins being compiled into the
+// age binary. This is how hardware-backed identities (YubiKey, TPM, secure
+// enclaves) are supported: age only needs to know how to find and talk to
+// "age-plugin-<name>" on PATH.
+//
+// A plugin recipient is encoded as Bech32 with an "age1<name>" human-readable
+// part, e.g. "age1yubikey1q...". A plugin identity is encoded as Bech32 with
+// an "AGE-PLUGIN-<NAME>-" human-readable part, e.g. "AGE-PLUGIN-YUBIKEY-1Q...".
+package plugin
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/johnkord/age"
+)
+
+// UI lets the caller surface plugin-originated messages and collect input,
+// without the plugin package knowing about terminals or TTYs.
+type UI struct {
+	// DisplayMessage shows an informational message from the plugin, sent in
+	// a "msg" stanza.
+	DisplayMessage func(message string) error
+
+	// RequestValue asks the user for a value. If secret is true, the value
+	// should not be echoed back (it came from a "request-secret" stanza);
+	// otherwise it came from a "prompt" stanza.
+	RequestValue func(message string, secret bool) (string, error)
+
+	// Confirm asks the user a yes/no question with the given labels for the
+	// two choices. It reports which one was chosen.
+	Confirm func(message, yes, no string) (chosen bool, err error)
+}
+
+// RecipientName reports whether s is a plugin-encoded recipient, and if so,
+// the name of the plugin that should handle it.
+func RecipientName(s string) (name string, ok bool) {
+	hrp, _, err := decodeBech32(s)
+	if err != nil || hrp == "age" || !strings.HasPrefix(hrp, "age1") {
+		return "", false
+	}
+	return hrp[len("age1"):], true
+}
+
+// IdentityName reports whether s is a plugin-encoded identity, and if so,
+// the name of the plugin that should handle it.
+func IdentityName(s string) (name string, ok bool) {
+	hrp, _, err := decodeBech32(s)
+	if err != nil || !strings.HasPrefix(hrp, "age-plugin-") || !strings.HasSuffix(hrp, "-") {
+		return "", false
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(hrp, "age-plugin-"), "-"), true
+}
+
+// Recipient is an age.Recipient that delegates wrapping to an
+// "age-plugin-<name>" executable.
+type Recipient struct {
+	name    string
+	encoded string
+	ui      UI
+}
+
+// NewRecipient parses a recipient encoding for the named plugin. The caller
+// is expected to have already identified name with RecipientName.
+func NewRecipient(encoded, name string, ui UI) (*Recipient, error) {
+	if _, _, err := decodeBech32(encoded); err != nil {
+		return nil, fmt.Errorf("malformed plugin recipient: %v", err)
+	}
+	return &Recipient{name: name, encoded: encoded, ui: ui}, nil
+}
+
+// Wrap implements age.Recipient.
+func (r *Recipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	conn, err := startPlugin(r.name, "recipient-v1")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.writeStanza("add-recipient", r.encoded); err != nil {
+		return nil, err
+	}
+	if err := conn.writeStanza("wrap-file-key", base64.RawStdEncoding.EncodeToString(fileKey)); err != nil {
+		return nil, err
+	}
+	if err := conn.writeStanza("done"); err != nil {
+		return nil, err
+	}
+
+	var stanzas []*age.Stanza
+	for {
+		s, err := conn.readStanza()
+		if err != nil {
+			return nil, err
+		}
+		switch s.typ {
+		case "recipient-stanza":
+			if len(s.args) < 2 {
+				return nil, fmt.Errorf("plugin %q: malformed recipient-stanza", r.name)
+			}
+			// args are [index, type, extra-args...]; the recipient-v1
+			// client only ever sends one file key, so the index is 0.
+			stanzas = append(stanzas, &age.Stanza{
+				Type: s.args[1],
+				Args: s.args[2:],
+				Body: s.body,
+			})
+		case "msg", "prompt", "request-secret", "confirm":
+			if err := r.ui.respond(conn, s); err != nil {
+				return nil, err
+			}
+		case "error":
+			return nil, pluginError(r.name, s)
+		case "done":
+			return stanzas, nil
+		default:
+			return nil, fmt.Errorf("plugin %q: unexpected stanza %q", r.name, s.typ)
+		}
+	}
+}
+
+// Identity is an age.Identity that delegates unwrapping to an
+// "age-plugin-<name>" executable.
+type Identity struct {
+	name    string
+	encoded string
+	ui      UI
+}
+
+// NewIdentity parses an identity encoding for the named plugin. The caller
+// is expected to have already identified name with IdentityName.
+func NewIdentity(encoded, name string, ui UI) (*Identity, error) {
+	if _, _, err := decodeBech32(encoded); err != nil {
+		return nil, fmt.Errorf("malformed plugin identity: %v", err)
+	}
+	return &Identity{name: name, encoded: encoded, ui: ui}, nil
+}
+
+// Unwrap implements age.Identity.
+func (i *Identity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	conn, err := startPlugin(i.name, "identity-v1")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.writeStanza("add-identity", i.encoded); err != nil {
+		return nil, err
+	}
+	for idx, s := range stanzas {
+		args := append([]string{strconv.Itoa(idx), s.Type}, s.Args...)
+		if err := conn.writeStanzaHeader("recipient-stanza", args...); err != nil {
+			return nil, err
+		}
+		if err := conn.writeStanzaBody(s.Body); err != nil {
+			return nil, err
+		}
+	}
+	if err := conn.writeStanza("done"); err != nil {
+		return nil, err
+	}
+
+	for {
+		s, err := conn.readStanza()
+		if err != nil {
+			return nil, err
+		}
+		switch s.typ {
+		case "file-key":
+			if len(s.args) < 1 {
+				return nil, fmt.Errorf("plugin %q: malformed file-key stanza", i.name)
+			}
+			if err := conn.writeStanza("ok"); err != nil {
+				return nil, err
+			}
+			return s.body, nil
+		case "msg", "prompt", "request-secret", "confirm":
+			if err := i.ui.respond(conn, s); err != nil {
+				return nil, err
+			}
+		case "error":
+			return nil, pluginError(i.name, s)
+		case "done":
+			return nil, age.ErrIncorrectIdentity
+		default:
+			return nil, fmt.Errorf("plugin %q: unexpected stanza %q", i.name, s.typ)
+		}
+	}
+}
+
+func (ui UI) respond(conn *pluginConn, s *ipcStanza) error {
+	message := string(s.body)
+	switch s.typ {
+	case "msg":
+		if ui.DisplayMessage == nil {
+			return conn.writeStanza("ok")
+		}
+		if err := ui.DisplayMessage(message); err != nil {
+			return err
+		}
+		return conn.writeStanza("ok")
+	case "prompt", "request-secret":
+		if ui.RequestValue == nil {
+			return conn.writeStanza("fail")
+		}
+		value, err := ui.RequestValue(message, s.typ == "request-secret")
+		if err != nil {
+			return conn.writeStanza("fail")
+		}
+		if err := conn.writeStanzaHeader("ok"); err != nil {
+			return err
+		}
+		return conn.writeStanzaBody([]byte(value))
+	case "confirm":
+		if ui.Confirm == nil {
+			return conn.writeStanza("fail")
+		}
+		var yes, no string
+		if len(s.args) > 0 {
+			yes = s.args[0]
+		}
+		if len(s.args) > 1 {
+			no = s.args[1]
+		}
+		chosen, err := ui.Confirm(message, yes, no)
+		if err != nil {
+			return conn.writeStanza("fail")
+		}
+		if chosen {
+			return conn.writeStanza("ok", "yes")
+		}
+		return conn.writeStanza("ok", "no")
+	default:
+		return fmt.Errorf("unexpected stanza %q in UI exchange", s.typ)
+	}
+}
+
+func pluginError(name string, s *ipcStanza) error {
+	if len(s.body) > 0 {
+		return fmt.Errorf("plugin %q encountered an error: %s", name, s.body)
+	}
+	return fmt.Errorf("plugin %q encountered an unspecified error", name)
+}
+
+// pluginConn wraps the subprocess running age-plugin-<name>, exchanging age
+// stanzas over its stdin and stdout.
+type pluginConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+func startPlugin(name, phase string) (*pluginConn, error) {
+	bin := "age-plugin-" + name
+	cmd := exec.Command(bin, "--age-plugin="+phase)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start %q: %v", bin, err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start %q: %v", bin, err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %q: %v\n\nIs the plugin installed and on your PATH?", bin, err)
+	}
+	return &pluginConn{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}, nil
+}
+
+func (c *pluginConn) Close() error {
+	c.stdin.Close()
+	return c.cmd.Wait()
+}
+
+// ipcStanza is one "-> type arg...\nbody\n" message of the plugin wire
+// protocol, which reuses the age file format's stanza encoding.
+type ipcStanza struct {
+	typ  string
+	args []string
+	body []byte
+}
+
+// writeStanza writes a full stanza with no body, i.e. a header line followed
+// by the mandatory (here, empty) body line that terminates every message in
+// the plugin wire protocol. Stanzas that carry a body of their own must call
+// writeStanzaHeader and writeStanzaBody directly instead.
+func (c *pluginConn) writeStanza(typ string, args ...string) error {
+	if err := c.writeStanzaHeader(typ, args...); err != nil {
+		return err
+	}
+	return c.writeStanzaBody(nil)
+}
+
+func (c *pluginConn) writeStanzaHeader(typ string, args ...string) error {
+	line := append([]string{"->", typ}, args...)
+	if _, err := fmt.Fprintln(c.stdin, strings.Join(line, " ")); err != nil {
+		return fmt.Errorf("failed to write to plugin: %v", err)
+	}
+	return nil
+}
+
+func (c *pluginConn) writeStanzaBody(body []byte) error {
+	enc := base64.RawStdEncoding.EncodeToString(body)
+	for len(enc) >= 64 {
+		if _, err := fmt.Fprintln(c.stdin, enc[:64]); err != nil {
+			return fmt.Errorf("failed to write to plugin: %v", err)
+		}
+		enc = enc[64:]
+	}
+	if _, err := fmt.Fprintln(c.stdin, enc); err != nil {
+		return fmt.Errorf("failed to write to plugin: %v", err)
+	}
+	return nil
+}
+
+func (c *pluginConn) readStanza() (*ipcStanza, error) {
+	line, err := c.stdout.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from plugin: %v", err)
+	}
+	fields := strings.Fields(strings.TrimSuffix(line, "\n"))
+	if len(fields) < 2 || fields[0] != "->" {
+		return nil, fmt.Errorf("malformed stanza from plugin: %q", line)
+	}
+	s := &ipcStanza{typ: fields[1], args: fields[2:]}
+	for {
+		bodyLine, err := c.stdout.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from plugin: %v", err)
+		}
+		bodyLine = strings.TrimSuffix(bodyLine, "\n")
+		chunk, err := base64.RawStdEncoding.DecodeString(bodyLine)
+		if err != nil {
+			return nil, fmt.Errorf("malformed stanza body from plugin: %v", err)
+		}
+		s.body = append(s.body, chunk...)
+		if len(bodyLine) < 64 {
+			break
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package plugin
+
+import (
+	"bufio"
+	"io"
+	"testing"
+)
+
+// pipeConn returns a pluginConn whose stdin is the write end of an in-memory
+// pipe, and a pluginConn wired to read back whatever gets written to it, so
+// tests can exercise writeStanza/readStanza without starting a subprocess.
+func pipeConn() (write *pluginConn, read *pluginConn) {
+	r, w := io.Pipe()
+	return &pluginConn{stdin: w}, &pluginConn{stdout: bufio.NewReader(r)}
+}
+
+// TestWriteStanzaTerminatesWithBody verifies that a no-body stanza (e.g.
+// "done") still emits the mandatory body line, even if empty: a
+// spec-compliant plugin blocks waiting for it after every header line, per
+// the age-plugin wire format that readStanza itself expects on the read
+// side.
+func TestWriteStanzaTerminatesWithBody(t *testing.T) {
+	w, r := pipeConn()
+	done := make(chan error, 1)
+	go func() { done <- w.writeStanza("done") }()
+
+	s, err := r.readStanza()
+	if err != nil {
+		t.Fatalf("readStanza: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("writeStanza: %v", err)
+	}
+	if s.typ != "done" || len(s.args) != 0 || len(s.body) != 0 {
+		t.Fatalf("got %+v, want empty done stanza", s)
+	}
+}
+
+// TestWriteStanzaHeaderThenBodyRoundTrips verifies that pairing
+// writeStanzaHeader with writeStanzaBody produces a single, correctly framed
+// stanza, as used for stanzas that carry a real (possibly large) body.
+func TestWriteStanzaHeaderThenBodyRoundTrips(t *testing.T) {
+	w, r := pipeConn()
+	body := make([]byte, 200) // forces writeStanzaBody to wrap across lines
+	for i := range body {
+		body[i] = byte(i)
+	}
+	done := make(chan error, 1)
+	go func() {
+		if err := w.writeStanzaHeader("recipient-stanza", "0", "X25519"); err != nil {
+			done <- err
+			return
+		}
+		done <- w.writeStanzaBody(body)
+	}()
+
+	s, err := r.readStanza()
+	if err != nil {
+		t.Fatalf("readStanza: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if s.typ != "recipient-stanza" || len(s.args) != 2 {
+		t.Fatalf("got %+v, want recipient-stanza with 2 args", s)
+	}
+	if string(s.body) != string(body) {
+		t.Fatalf("body round-trip mismatch: got %v, want %v", s.body, body)
+	}
+}
+
+// TestReadStanzaAfterWriteStanzaDoesNotBlock is a regression test for a bug
+// where writeStanza wrote only the header line: a second stanza written
+// right after the first would then be misread as the first stanza's body.
+func TestReadStanzaAfterWriteStanzaDoesNotBlock(t *testing.T) {
+	w, r := pipeConn()
+	done := make(chan error, 1)
+	go func() {
+		if err := w.writeStanza("add-recipient", "age1exampleexampleexample"); err != nil {
+			done <- err
+			return
+		}
+		done <- w.writeStanza("done")
+	}()
+
+	first, err := r.readStanza()
+	if err != nil {
+		t.Fatalf("readStanza (1): %v", err)
+	}
+	if first.typ != "add-recipient" {
+		t.Fatalf("got %q, want add-recipient", first.typ)
+	}
+	second, err := r.readStanza()
+	if err != nil {
+		t.Fatalf("readStanza (2): %v", err)
+	}
+	if second.typ != "done" {
+		t.Fatalf("got %q, want done", second.typ)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}